@@ -0,0 +1,13 @@
+package bitcoin
+
+// Vout mirrors the output shape used by modern Esplora-style chain APIs
+// (the JSON returned from GET /tx/:txid), specifically the previous
+// output an input spends. ChainClient.Vout resolves an outpoint
+// (txid:vout) to this shape so the listener can recognize money leaving
+// one of its own addresses without the wallet callback itself having to
+// carry the previous output's details.
+type Vout struct {
+	ScriptPubkey     []byte
+	ScriptPubkeyAddr string
+	Value            int64
+}
@@ -0,0 +1,416 @@
+package bitcoin
+
+import (
+	"github.com/OpenBazaar/openbazaar-go/api/notifications"
+	"github.com/OpenBazaar/openbazaar-go/pb"
+	"github.com/OpenBazaar/openbazaar-go/repo"
+	"strings"
+	"time"
+)
+
+// DefaultSaleConfirmationsRequired is the recommended number of
+// confirmations a direct payment needs before an order is transitioned to
+// FUNDED. It's only a suggested default for NewConfirmationTracker: nodes
+// that want a different depth (or escrow/moderated orders, which should
+// use a deeper threshold in the 3-6 range since a reorg that un-funds them
+// is more costly to unwind once a moderator is involved) configure it per
+// tracker instead of relying on a package constant.
+const DefaultSaleConfirmationsRequired = 1
+
+// DefaultModeratedConfirmationsRequired is the recommended depth for
+// orders that involve a moderator.
+const DefaultModeratedConfirmationsRequired = 3
+
+// OrderFundedNotification wraps the stock notifications.OrderNotification
+// with the coin the payment arrived in. notifications.OrderNotification
+// itself lives upstream in api/notifications and can't be given a
+// CoinType field from here, so the coin is carried alongside it instead.
+type OrderFundedNotification struct {
+	notifications.OrderNotification
+	CoinType string `json:"coinType"`
+}
+
+// ChainTip describes the confirmation status of a transaction as reported
+// by an Esplora-style chain API (GET /tx/:txid).
+type ChainTip struct {
+	Confirmed   bool
+	BlockHeight uint32
+	BlockHash   string
+}
+
+// ChainClient is the minimal interface the listener and confirmation
+// tracker need from a block explorer / indexer. Esplora (and its
+// electrs-based equivalents) satisfy it directly.
+type ChainClient interface {
+	// Tip returns the current confirmation status for txid.
+	Tip(txid string) (ChainTip, error)
+
+	// Vout resolves the output at index vout of txid, letting the
+	// listener recognize an input as spending from one of its own
+	// addresses without the wallet callback carrying that detail itself.
+	Vout(txid string, vout uint32) (Vout, error)
+}
+
+// pendingRecord mirrors the subset of TransactionRecord the tracker needs:
+// whether the chain previously reported this txid as confirmed, the
+// funding inputs it spends (so the tracker can keep checking them against
+// the mempool for a replacement), and any conflicting replacement already
+// recorded against it.
+type pendingRecord struct {
+	Txid          string
+	WasConfirmed  bool
+	Inputs        []string
+	ConflictsWith string
+}
+
+// PaymentReorgNotification is broadcast when a previously-confirmed
+// payment is reorged out and its order is rolled back to CONFIRMED.
+type PaymentReorgNotification struct {
+	OrderId string `json:"orderId"`
+	Txid    string `json:"txid"`
+}
+
+// ConfirmationTracker polls a ChainClient for each pending TransactionRecord
+// until it reaches the required confirmation depth, at which point the
+// order is moved to FUNDED. It also detects reorgs: if a record that was
+// previously confirmed reports a different block hash (or reverts to
+// unconfirmed), the order is rolled back to CONFIRMED and its inventory
+// restored. The last-seen block hash for each record is persisted in
+// repo.Datastore so polling resumes correctly across restarts.
+type ConfirmationTracker struct {
+	db                             repo.Datastore
+	chain                          ChainClient
+	listener                       *MultiwalletListener
+	broadcast                      chan []byte
+	interval                       time.Duration
+	saleConfirmationsRequired      uint32
+	moderatedConfirmationsRequired uint32
+	partialPaymentGraceWindow      time.Duration
+	quit                           chan struct{}
+}
+
+// NewConfirmationTracker builds a tracker that polls every interval.
+// saleConfirmationsRequired and moderatedConfirmationsRequired configure
+// how deep a direct payment and a moderated order, respectively, must
+// confirm before the order transitions to FUNDED; pass
+// DefaultSaleConfirmationsRequired / DefaultModeratedConfirmationsRequired
+// to get the recommended depths. partialPaymentGraceWindow configures how
+// long a sale may sit underfunded before it's flagged as a partial
+// payment; pass DefaultPartialPaymentGraceWindow for the recommended
+// window.
+func NewConfirmationTracker(db repo.Datastore, chain ChainClient, listener *MultiwalletListener, broadcast chan []byte, interval time.Duration, saleConfirmationsRequired, moderatedConfirmationsRequired uint32, partialPaymentGraceWindow time.Duration) *ConfirmationTracker {
+	return &ConfirmationTracker{db, chain, listener, broadcast, interval, saleConfirmationsRequired, moderatedConfirmationsRequired, partialPaymentGraceWindow, make(chan struct{})}
+}
+
+// Start begins polling in the background. Stop must be called to release
+// the underlying ticker.
+func (t *ConfirmationTracker) Start() {
+	go func() {
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.poll()
+			case <-t.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (t *ConfirmationTracker) Stop() {
+	close(t.quit)
+}
+
+func (t *ConfirmationTracker) poll() {
+	pending, err := t.db.Sales().GetPendingConfirmation()
+	if err != nil {
+		return
+	}
+	for _, p := range pending {
+		t.pollRecord(p.Contract, p.State, p.CoinType, p.Records, t.requiredConfirmations(p.Contract))
+	}
+	purchasePending, err := t.db.Purchases().GetPendingConfirmation()
+	if err == nil {
+		for _, p := range purchasePending {
+			t.pollPurchaseRecord(p.Contract, p.State, p.CoinType, p.Records, t.requiredConfirmations(p.Contract))
+		}
+	}
+	t.checkPartialPayments()
+}
+
+// checkPartialPayments flags sales that are still underfunded after
+// partialPaymentGraceWindow has elapsed since their last observed payment.
+// Each sale is only notified once per underfunded episode: GetUnderfundedSince
+// reports whether it already has, and a successful notify is recorded via
+// MarkPartialPaymentNotified so the next poll tick doesn't repeat it.
+func (t *ConfirmationTracker) checkPartialPayments() {
+	underfunded, err := t.db.Sales().GetUnderfundedSince(time.Now().Add(-t.partialPaymentGraceWindow))
+	if err != nil {
+		return
+	}
+	for _, u := range underfunded {
+		if u.Notified {
+			continue
+		}
+		orderId, err := calcOrderId(u.Contract.BuyerOrder)
+		if err != nil {
+			continue
+		}
+		n := notifications.Serialize(
+			PartialPaymentNotification{
+				orderId,
+				int64(u.Contract.BuyerOrder.Payment.Amount),
+				u.Received,
+			})
+		t.broadcast <- n
+		t.db.Sales().MarkPartialPaymentNotified(orderId)
+	}
+}
+
+// requiredConfirmations returns the tracker's configured depth for a
+// direct payment, or its deeper moderated depth once the order involves a
+// moderator.
+func (t *ConfirmationTracker) requiredConfirmations(contract *pb.RicardianContract) uint32 {
+	if contract.BuyerOrder.Payment.Moderator != "" {
+		return t.moderatedConfirmationsRequired
+	}
+	return t.saleConfirmationsRequired
+}
+
+func (t *ConfirmationTracker) pollRecord(contract *pb.RicardianContract, state pb.OrderState, coinType CoinType, records []pendingRecord, required uint32) {
+	orderId, err := calcOrderId(contract.BuyerOrder)
+	if err != nil {
+		return
+	}
+	wallet, ok := t.listener.wallets[coinType]
+	if !ok {
+		return
+	}
+
+	// First pass: resolve conflicts and reorg rollbacks for every record of
+	// this order before deciding anything about funding. Doing this in one
+	// interleaved pass let a record that just crossed the required depth
+	// get set FUNDED only to have a sibling record's rollback immediately
+	// flip it back within the same tick; separating the passes means the
+	// funded decision below only ever sees the tick's final outcome.
+	rolledBack := false
+	var outcomes []recordOutcome
+	for _, r := range records {
+		if r.ConflictsWith != "" {
+			continue
+		}
+		if replacementTxid, replacementFee, conflict := findConflict(t.listener.mempool, r.Inputs, r.Txid); conflict {
+			log.Warningf("Conflicting spend of a funding input for order %s: %s replaces %s", orderId, replacementTxid, r.Txid)
+			t.db.Sales().PutConflict(orderId, r.Txid, replacementTxid)
+
+			n := notifications.Serialize(
+				DoubleSpendNotification{
+					orderId,
+					r.Txid,
+					replacementTxid,
+					replacementFee,
+				})
+			t.broadcast <- n
+			continue
+		}
+		tip, err := t.chain.Tip(r.Txid)
+		if err != nil {
+			continue
+		}
+		lastHash, err := t.db.Sales().GetLastSeenBlockHash(orderId, r.Txid)
+		if err == nil && lastHash != "" && r.WasConfirmed && (!tip.Confirmed || tip.BlockHash != lastHash) {
+			t.rollback(contract, orderId, r.Txid, state == pb.OrderState_FUNDED && !rolledBack)
+			rolledBack = true
+			continue
+		}
+		if !tip.Confirmed {
+			continue
+		}
+		t.db.Sales().PutLastSeenBlockHash(orderId, r.Txid, tip.BlockHash)
+		confirmations, err := wallet.ConfirmationsFor(r.Txid)
+		if err != nil {
+			continue
+		}
+		outcomes = append(outcomes, recordOutcome{r.Txid, confirmations})
+	}
+
+	if !decideFunding(state == pb.OrderState_FUNDED, rolledBack, outcomes, required) {
+		return
+	}
+	t.db.Sales().Put(orderId, *contract, pb.OrderState_FUNDED, false)
+	t.listener.adjustInventory(contract)
+
+	n := notifications.Serialize(
+		OrderFundedNotification{
+			notifications.OrderNotification{
+				contract.VendorListings[0].Item.Title,
+				contract.BuyerOrder.BuyerID.Guid,
+				contract.BuyerOrder.BuyerID.BlockchainID,
+				contract.VendorListings[0].Item.Images[0].Hash,
+				int(contract.BuyerOrder.Timestamp.Seconds),
+				orderId,
+			},
+			string(coinType),
+		})
+	t.broadcast <- n
+}
+
+// recordOutcome carries the confirmation count a pending record reached
+// this tick, for records that neither conflicted nor rolled back.
+type recordOutcome struct {
+	Txid          string
+	Confirmations uint32
+}
+
+// decideFunding resolves a poll tick's surviving record outcomes into a
+// single funding decision. It refuses to fund if the order is already
+// FUNDED or if any of its records rolled back this tick, and otherwise
+// funds as soon as one record reached the required depth.
+func decideFunding(alreadyFunded, rolledBack bool, outcomes []recordOutcome, required uint32) bool {
+	if alreadyFunded || rolledBack {
+		return false
+	}
+	for _, o := range outcomes {
+		if o.Confirmations >= required {
+			return true
+		}
+	}
+	return false
+}
+
+// pollPurchaseRecord mirrors pollRecord for the buyer side of an order:
+// once a purchase's funding transactions reach the required confirmation
+// depth it transitions to FUNDED, and a reorg that un-confirms a
+// previously-confirmed payment rolls it back to CONFIRMED.
+func (t *ConfirmationTracker) pollPurchaseRecord(contract *pb.RicardianContract, state pb.OrderState, coinType CoinType, records []pendingRecord, required uint32) {
+	orderId, err := calcOrderId(contract.BuyerOrder)
+	if err != nil {
+		return
+	}
+	wallet, ok := t.listener.wallets[coinType]
+	if !ok {
+		return
+	}
+	// See pollRecord: conflicts and rollbacks are resolved for every record
+	// of this order first, and the funding decision is made once from the
+	// surviving outcomes, so one record's rollback can never be
+	// immediately undone by another record funding within the same tick.
+	rolledBack := false
+	var outcomes []recordOutcome
+	for _, r := range records {
+		if r.ConflictsWith != "" {
+			continue
+		}
+		if replacementTxid, replacementFee, conflict := findConflict(t.listener.mempool, r.Inputs, r.Txid); conflict {
+			log.Warningf("Conflicting spend of a funding input for purchase %s: %s replaces %s", orderId, replacementTxid, r.Txid)
+			t.db.Purchases().PutConflict(orderId, r.Txid, replacementTxid)
+
+			n := notifications.Serialize(
+				DoubleSpendNotification{
+					orderId,
+					r.Txid,
+					replacementTxid,
+					replacementFee,
+				})
+			t.broadcast <- n
+			continue
+		}
+		tip, err := t.chain.Tip(r.Txid)
+		if err != nil {
+			continue
+		}
+		lastHash, err := t.db.Purchases().GetLastSeenBlockHash(orderId, r.Txid)
+		if err == nil && lastHash != "" && r.WasConfirmed && (!tip.Confirmed || tip.BlockHash != lastHash) {
+			t.rollbackPurchase(contract, orderId, r.Txid)
+			rolledBack = true
+			continue
+		}
+		if !tip.Confirmed {
+			continue
+		}
+		t.db.Purchases().PutLastSeenBlockHash(orderId, r.Txid, tip.BlockHash)
+		confirmations, err := wallet.ConfirmationsFor(r.Txid)
+		if err != nil {
+			continue
+		}
+		outcomes = append(outcomes, recordOutcome{r.Txid, confirmations})
+	}
+
+	if !decideFunding(state == pb.OrderState_FUNDED, rolledBack, outcomes, required) {
+		return
+	}
+	t.db.Purchases().Put(orderId, *contract, pb.OrderState_FUNDED, true)
+
+	n := notifications.Serialize(
+		PurchaseFundedNotification{
+			notifications.PaymentNotification{orderId},
+			string(coinType),
+		})
+	t.broadcast <- n
+}
+
+// rollbackPurchase reverts a purchase that lost its funding confirmation
+// to a reorg back to CONFIRMED.
+func (t *ConfirmationTracker) rollbackPurchase(contract *pb.RicardianContract, orderId string, txid string) {
+	log.Warningf("Payment tx %s for purchase %s was reorged out, rolling back to CONFIRMED", txid, orderId)
+	t.db.Purchases().Put(orderId, *contract, pb.OrderState_CONFIRMED, true)
+
+	n := notifications.Serialize(
+		PaymentReorgNotification{
+			orderId,
+			txid,
+		})
+	t.broadcast <- n
+}
+
+// rollback reverts an order that lost its funding confirmation to a reorg:
+// the order moves back to CONFIRMED and any inventory debited when it was
+// marked FUNDED is restored. restoreInv is false when the order was not
+// FUNDED, or when another record of it already restored inventory this tick.
+func (t *ConfirmationTracker) rollback(contract *pb.RicardianContract, orderId string, txid string, restoreInv bool) {
+	log.Warningf("Payment tx %s for order %s was reorged out, rolling back to CONFIRMED", txid, orderId)
+	t.db.Sales().Put(orderId, *contract, pb.OrderState_CONFIRMED, false)
+	if restoreInv {
+		t.restoreInventory(contract)
+	}
+
+	n := notifications.Serialize(
+		PaymentReorgNotification{
+			orderId,
+			txid,
+		})
+	t.broadcast <- n
+}
+
+func (t *ConfirmationTracker) restoreInventory(contract *pb.RicardianContract) {
+	inventory, err := t.db.Inventory().GetAll()
+	if err != nil {
+		return
+	}
+	for _, item := range contract.BuyerOrder.Items {
+		var variants []string
+		for _, option := range item.Options {
+			variants = append(variants, option.Value)
+		}
+		for path, c := range inventory {
+			contains := true
+		vi:
+			for i := 0; i < len(variants); i++ {
+				if !strings.Contains(path, variants[i]) {
+					contains = false
+					break vi
+				}
+			}
+			// adjustInventory only ever debits when c > 0, clamping the
+			// debit to 0 (a no-op) when stock was already exhausted.
+			// Mirroring that same gate here keeps a rollback from crediting
+			// back stock that debiting never actually took in the first
+			// place.
+			if contains && c > 0 {
+				t.db.Inventory().Put(path, c+int(item.Quantity))
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package bitcoin
+
+import "testing"
+
+func TestDecideFunding(t *testing.T) {
+	tests := []struct {
+		name          string
+		alreadyFunded bool
+		rolledBack    bool
+		outcomes      []recordOutcome
+		required      uint32
+		want          bool
+	}{
+		{
+			name:     "no records yet",
+			required: 1,
+			want:     false,
+		},
+		{
+			name:     "single record reaches required depth",
+			outcomes: []recordOutcome{{"a", 1}},
+			required: 1,
+			want:     true,
+		},
+		{
+			name:     "single record short of required depth",
+			outcomes: []recordOutcome{{"a", 1}},
+			required: 3,
+			want:     false,
+		},
+		{
+			name:          "already funded is never re-funded",
+			alreadyFunded: true,
+			outcomes:      []recordOutcome{{"a", 5}},
+			required:      1,
+			want:          false,
+		},
+		{
+			name:       "a sibling record's rollback this tick blocks funding",
+			rolledBack: true,
+			outcomes:   []recordOutcome{{"a", 5}},
+			required:   1,
+			want:       false,
+		},
+		{
+			name:     "funds as soon as any surviving record clears depth",
+			outcomes: []recordOutcome{{"a", 0}, {"b", 2}},
+			required: 1,
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decideFunding(tt.alreadyFunded, tt.rolledBack, tt.outcomes, tt.required)
+			if got != tt.want {
+				t.Errorf("decideFunding() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Package bitcoin dispatches wallet transaction callbacks into the sale
+// and purchase order state machines.
+//
+// MultiwalletListener and ConfirmationTracker assume repo.Datastore's
+// Sales() and Purchases() stores carry a CoinType column on orders and
+// expose the following additions on top of their existing API:
+//
+//	GetByPaymentAddress(addr string, coinType CoinType) (*pb.RicardianContract, pb.OrderState, bool, []spvwallet.TransactionRecord, error)
+//	GetByRefundAddress(addr string, coinType CoinType) (*pb.RicardianContract, pb.OrderState, []spvwallet.TransactionRecord, error)
+//	GetByEscrowAddress(addr string, coinType CoinType) (*pb.RicardianContract, pb.OrderState, []spvwallet.TransactionRecord, error)
+//	GetPendingConfirmation() returning, per pending order, its contract,
+//	  current state, coin type, and the pendingRecord-shaped funding
+//	  records the tracker should poll - each record carrying the funding
+//	  inputs it spends and any conflicting replacement already recorded
+//	  against it
+//	GetLastSeenBlockHash(orderId, txid string) (string, error)
+//	PutLastSeenBlockHash(orderId, txid, blockHash string) error
+//	PutConflict(orderId, txid, replacementTxid string) error
+//	PutOverpayment(orderId string, delta int64) error
+//	GetOverpayment(orderId string) (*pb.RicardianContract, pb.OrderState, bool, int64, CoinType, error),
+//	  where the bool reports whether the overpayment has already been refunded
+//	MarkOverpaymentRefunded(orderId string) error
+//	GetPartialPayment(orderId string) (*pb.RicardianContract, bool, int64, CoinType, error),
+//	  where the bool reports whether the partial payment has already been refunded
+//	MarkPartialPaymentRefunded(orderId string) error
+//	GetUnderfundedSince(since time.Time) ([]UnderfundedSale, error)
+//	MarkPartialPaymentNotified(orderId string) error
+//	PutRefundTxid(orderId, txid string) error
+//
+// repo.Datastore is maintained upstream (github.com/OpenBazaar/openbazaar-go)
+// and isn't part of this module, so this package can't carry its
+// implementation; this list is the contract the datastore change
+// accompanying this series needs to satisfy.
+//
+// This package also assumes the following on spvwallet's side:
+//
+//	TransactionCallback.Inputs []TransactionInput - the inputs the
+//	  callback's transaction spends, needed to check each one against
+//	  MempoolClient for a competing replacement.
+//	TransactionInput.OutpointHash string / OutpointIndex uint32 - the
+//	  previous output (txid:vout) a given input spends.
+//	TransactionRecord.Inputs []string - the funding inputs this record
+//	  spends, as "txid:vout" keys (see outpointKey/parseOutpointKey).
+//	  TransactionRecord is an spvwallet type, so its Inputs field can't be
+//	  given a type this package owns - that would make spvwallet import
+//	  bitcoin, which already imports spvwallet.
+//	TransactionRecord.ConflictsWith string - the replacement txid a
+//	  funding input of this record was spent by, if detectConflict or the
+//	  tracker's poll loop has found one; empty otherwise.
+//
+// spvwallet is likewise maintained upstream (github.com/OpenBazaar/spvwallet)
+// and isn't part of this module.
+package bitcoin
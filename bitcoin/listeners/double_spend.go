@@ -0,0 +1,121 @@
+package bitcoin
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/OpenBazaar/spvwallet"
+	"strconv"
+	"strings"
+)
+
+// OutspendStatus carries the block the spending transaction confirmed in,
+// mirroring the `status` object an Esplora-style API nests inside an
+// outspend response.
+type OutspendStatus struct {
+	Confirmed   bool
+	BlockHeight uint32
+	BlockHash   string
+}
+
+// Outspend describes whether a given output has already been spent, as
+// reported by GET /tx/:txid/outspend/:vout.
+type Outspend struct {
+	Spent  bool
+	Txid   string
+	Vin    uint32
+	Status OutspendStatus
+}
+
+// MempoolClient is the minimal interface the listener needs to detect
+// competing spends of a funding input before it has confirmed.
+type MempoolClient interface {
+	// Outspend reports whether the output at vout of txid has been spent,
+	// and if so by what transaction.
+	Outspend(txid string, vout uint32) (Outspend, error)
+
+	// Fee returns the total fee paid by txid, used to report the fee a
+	// replacement transaction paid.
+	Fee(txid string) (int64, error)
+}
+
+// DoubleSpendNotification is broadcast when a transaction funding an order
+// is replaced by a competing spend of the same input before reaching
+// FUNDED. The replacement's fee is reported but not compared with the
+// original's.
+type DoubleSpendNotification struct {
+	OrderId         string `json:"orderId"`
+	OriginalTxid    string `json:"originalTxid"`
+	ReplacementTxid string `json:"replacementTxid"`
+	ReplacementFee  int64  `json:"replacementFee"`
+}
+
+// detectConflict checks whether any input of cb has already been spent by
+// some other transaction, i.e. a competing replacement of this one. It
+// returns the competing (replacement) txid and its fee when a conflict is
+// found.
+func (l *MultiwalletListener) detectConflict(cb spvwallet.TransactionCallback) (replacementTxid string, replacementFee int64, conflict bool) {
+	return findConflict(l.mempool, outpointsOf(cb.Inputs), hex.EncodeToString(cb.Txid))
+}
+
+// outpointsOf converts a transaction's inputs to the "txid:vout" key shape
+// findConflict needs. TransactionRecord also carries these for its funding
+// inputs so ConfirmationTracker can keep checking for a replacement spend
+// long after the wallet callback that produced cb - as plain strings, since
+// TransactionRecord is an spvwallet type and can't be given a field of a
+// type this package owns without spvwallet importing it back.
+func outpointsOf(inputs []spvwallet.TransactionInput) []string {
+	outpoints := make([]string, len(inputs))
+	for i, in := range inputs {
+		outpoints[i] = outpointKey(in.OutpointHash, in.OutpointIndex)
+	}
+	return outpoints
+}
+
+// outpointKey formats a previous output as the "txid:vout" string
+// findConflict and outpointsOf use to identify it.
+func outpointKey(txid string, vout uint32) string {
+	return fmt.Sprintf("%s:%d", txid, vout)
+}
+
+// parseOutpointKey reverses outpointKey. It reports ok=false for a
+// malformed key instead of erroring, since a bad key can only come from
+// corrupted persisted data and findConflict treats it the same as an
+// outpoint it can't otherwise resolve: skip it.
+func parseOutpointKey(key string) (txid string, vout uint32, ok bool) {
+	i := strings.LastIndex(key, ":")
+	if i < 0 {
+		return "", 0, false
+	}
+	n, err := strconv.ParseUint(key[i+1:], 10, 32)
+	if err != nil {
+		return "", 0, false
+	}
+	return key[:i], uint32(n), true
+}
+
+// findConflict checks whether any of outpoints has already been spent by
+// some transaction other than thisTxid, i.e. a competing replacement. It's
+// shared by detectConflict, which runs once when a funding tx first
+// arrives, and ConfirmationTracker's poll loop, which re-runs it on every
+// tick for as long as a record is still pending so a replacement broadcast
+// later - to inputs the wallet itself never sees again - is still caught.
+func findConflict(mempool MempoolClient, outpoints []string, thisTxid string) (replacementTxid string, replacementFee int64, conflict bool) {
+	if mempool == nil {
+		return "", 0, false
+	}
+	for _, key := range outpoints {
+		txid, vout, ok := parseOutpointKey(key)
+		if !ok {
+			continue
+		}
+		out, err := mempool.Outspend(txid, vout)
+		if err != nil || !out.Spent {
+			continue
+		}
+		if out.Txid != "" && out.Txid != thisTxid {
+			fee, _ := mempool.Fee(out.Txid)
+			return out.Txid, fee, true
+		}
+	}
+	return "", 0, false
+}
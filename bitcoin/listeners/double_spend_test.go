@@ -0,0 +1,82 @@
+package bitcoin
+
+import (
+	"testing"
+)
+
+// fakeMempool is a minimal MempoolClient stub keyed by "txid:vout".
+type fakeMempool struct {
+	outspends map[string]Outspend
+	fees      map[string]int64
+}
+
+func (m *fakeMempool) Outspend(txid string, vout uint32) (Outspend, error) {
+	return m.outspends[outpointKey(txid, vout)], nil
+}
+
+func (m *fakeMempool) Fee(txid string) (int64, error) {
+	return m.fees[txid], nil
+}
+
+func TestFindConflict(t *testing.T) {
+	tests := []struct {
+		name         string
+		mempool      MempoolClient
+		outpoints    []string
+		thisTxid     string
+		wantReplace  string
+		wantFee      int64
+		wantConflict bool
+	}{
+		{
+			name:         "no mempool client configured",
+			mempool:      nil,
+			outpoints:    []string{outpointKey("funding-tx", 0)},
+			thisTxid:     "this-tx",
+			wantConflict: false,
+		},
+		{
+			name: "input unspent",
+			mempool: &fakeMempool{
+				outspends: map[string]Outspend{},
+			},
+			outpoints:    []string{outpointKey("funding-tx", 0)},
+			thisTxid:     "this-tx",
+			wantConflict: false,
+		},
+		{
+			name: "input spent by this same tx is not a conflict",
+			mempool: &fakeMempool{
+				outspends: map[string]Outspend{
+					"funding-tx:0": {Spent: true, Txid: "this-tx"},
+				},
+			},
+			outpoints:    []string{outpointKey("funding-tx", 0)},
+			thisTxid:     "this-tx",
+			wantConflict: false,
+		},
+		{
+			name: "input spent by a competing replacement",
+			mempool: &fakeMempool{
+				outspends: map[string]Outspend{
+					"funding-tx:0": {Spent: true, Txid: "replacement-tx"},
+				},
+				fees: map[string]int64{"replacement-tx": 5000},
+			},
+			outpoints:    []string{outpointKey("funding-tx", 0)},
+			thisTxid:     "this-tx",
+			wantReplace:  "replacement-tx",
+			wantFee:      5000,
+			wantConflict: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotReplace, gotFee, gotConflict := findConflict(tt.mempool, tt.outpoints, tt.thisTxid)
+			if gotConflict != tt.wantConflict || gotReplace != tt.wantReplace || gotFee != tt.wantFee {
+				t.Errorf("findConflict() = (%q, %d, %v), want (%q, %d, %v)",
+					gotReplace, gotFee, gotConflict, tt.wantReplace, tt.wantFee, tt.wantConflict)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package bitcoin
+
+import (
+	"encoding/hex"
+	"github.com/OpenBazaar/openbazaar-go/api/notifications"
+	"github.com/OpenBazaar/openbazaar-go/pb"
+	"github.com/OpenBazaar/spvwallet"
+)
+
+// processOutgoingPayment recognizes money leaving one of the node's own
+// addresses - a refund sent to a buyer, a moderator releasing escrow, or a
+// manual spend - by resolving the spent input's previous output via
+// ChainClient.Vout and matching its address against the sale's refund or
+// escrow address, rather than only ever watching for money coming in on
+// the payment address.
+func (l *MultiwalletListener) processOutgoingPayment(coinType CoinType, cb spvwallet.TransactionCallback, in spvwallet.TransactionInput, prevout Vout) {
+	contract, state, records, err := l.db.Sales().GetByRefundAddress(prevout.ScriptPubkeyAddr, coinType)
+	if err == nil {
+		l.recordOutgoingSaleTx(cb, prevout, contract, state, records, pb.OrderState_REFUNDED)
+		return
+	}
+	contract, state, records, err = l.db.Sales().GetByEscrowAddress(prevout.ScriptPubkeyAddr, coinType)
+	if err == nil {
+		l.recordOutgoingSaleTx(cb, prevout, contract, state, records, pb.OrderState_COMPLETE)
+		return
+	}
+}
+
+func (l *MultiwalletListener) recordOutgoingSaleTx(cb spvwallet.TransactionCallback, prevout Vout, contract *pb.RicardianContract, state pb.OrderState, records []spvwallet.TransactionRecord, newState pb.OrderState) {
+	txid := hex.EncodeToString(cb.Txid)
+	for _, r := range records {
+		if r.Txid == txid {
+			return
+		}
+	}
+	orderId, err := calcOrderId(contract.BuyerOrder)
+	if err != nil {
+		return
+	}
+	record := spvwallet.TransactionRecord{
+		Txid:  txid,
+		Value: -prevout.Value,
+	}
+	records = append(records, record)
+	l.db.Sales().UpdateFunding(orderId, true, records)
+
+	if state != newState {
+		l.db.Sales().Put(orderId, *contract, newState, false)
+
+		n := notifications.Serialize(
+			OutgoingPaymentNotification{
+				orderId,
+				txid,
+				newState.String(),
+			})
+		l.broadcast <- n
+	}
+}
+
+// OutgoingPaymentNotification is broadcast when the node observes one of
+// its own addresses spending out - a refund, an escrow release, or a
+// manual send - and updates the order's state to match.
+type OutgoingPaymentNotification struct {
+	OrderId string `json:"orderId"`
+	Txid    string `json:"txid"`
+	State   string `json:"state"`
+}
@@ -0,0 +1,136 @@
+package bitcoin
+
+import (
+	"errors"
+	"github.com/OpenBazaar/openbazaar-go/pb"
+	"time"
+)
+
+// UnderfundedSale describes a sale that has received some payment but has
+// not yet reached its requested amount, as returned by
+// repo.Datastore.Sales().GetUnderfundedSince. Notified records whether a
+// PartialPaymentNotification has already gone out for this sale so the
+// tracker only fires it once per underfunded episode instead of on every
+// poll tick.
+type UnderfundedSale struct {
+	Contract *pb.RicardianContract
+	Received int64
+	Notified bool
+}
+
+// DustThreshold is the smallest overpayment delta worth recording. Deltas at
+// or below this are treated as normal fee-estimation noise, not a genuine
+// overpayment.
+const DustThreshold int64 = 546
+
+// DefaultPartialPaymentGraceWindow is the recommended length of time a
+// sale is allowed to sit underfunded, counted from its last observed
+// payment, before it's flagged as a partial payment. It's only a
+// suggested default for NewConfirmationTracker - nodes that want a
+// different grace period configure it per tracker instead of relying on
+// a package constant.
+const DefaultPartialPaymentGraceWindow = 24 * time.Hour
+
+// OverpaymentNotification is broadcast when a buyer sends more than the
+// requested amount for an order.
+type OverpaymentNotification struct {
+	OrderId  string `json:"orderId"`
+	Expected int64  `json:"expected"`
+	Received int64  `json:"received"`
+	Delta    int64  `json:"delta"`
+}
+
+// PartialPaymentNotification is broadcast when an order is still
+// underfunded after the tracker's configured grace window has elapsed
+// since its last payment.
+type PartialPaymentNotification struct {
+	OrderId  string `json:"orderId"`
+	Expected int64  `json:"expected"`
+	Received int64  `json:"received"`
+}
+
+// refundable reports whether a recorded refund of amount can proceed: it
+// can't if it's already been refunded, or if there's nothing recorded to
+// refund. It's shared by RefundOverpayment and RefundPartialPayment, pulled
+// out as a pure function so the double-refund guard can be tested without
+// a repo.Datastore fake.
+func refundable(refunded bool, amount int64) (ok bool, alreadyRefunded bool) {
+	if refunded {
+		return false, true
+	}
+	if amount <= 0 {
+		return false, false
+	}
+	return true, false
+}
+
+// RefundOverpayment refunds the recorded overpayment delta for orderId to
+// the buyer's refund address and records the refund txid back onto the
+// order's transaction history. The full delta is passed to Wallet.Spend;
+// network fees are not deducted from it. It's a no-op if the
+// overpayment has already been refunded, so a retried or duplicate call
+// can't broadcast a second real spend for money that's already gone out.
+func (l *MultiwalletListener) RefundOverpayment(orderId string) (string, error) {
+	l.Lock()
+	defer l.Unlock()
+	contract, _, refunded, delta, coinType, err := l.db.Sales().GetOverpayment(orderId)
+	if err != nil {
+		return "", err
+	}
+	if ok, alreadyRefunded := refundable(refunded, delta); !ok {
+		if alreadyRefunded {
+			return "", errors.New("overpayment for this order has already been refunded")
+		}
+		return "", errors.New("no overpayment recorded for this order")
+	}
+	wallet, ok := l.wallets[coinType]
+	if !ok {
+		return "", errors.New("no wallet registered for coin " + string(coinType))
+	}
+	txid, err := wallet.Spend(delta, contract.BuyerOrder.RefundAddress)
+	if err != nil {
+		return "", err
+	}
+	// Only marked refunded once the spend has actually gone out: marking it
+	// first and then failing the spend would strand the delta with no way
+	// to retry, since a later call would see refunded=true and refuse.
+	l.db.Sales().MarkOverpaymentRefunded(orderId)
+	l.db.Sales().PutRefundTxid(orderId, txid)
+	return txid, nil
+}
+
+// RefundPartialPayment refunds whatever was received so far on an
+// underfunded order back to the buyer's refund address and records the
+// refund txid back onto the order's transaction history. The full received
+// amount is passed to Wallet.Spend; network fees are not deducted from it.
+// It's a no-op if the partial payment has already been refunded,
+// so a retried or duplicate call can't broadcast a second real spend for
+// money that's already gone out.
+func (l *MultiwalletListener) RefundPartialPayment(orderId string) (string, error) {
+	l.Lock()
+	defer l.Unlock()
+	contract, refunded, received, coinType, err := l.db.Sales().GetPartialPayment(orderId)
+	if err != nil {
+		return "", err
+	}
+	if ok, alreadyRefunded := refundable(refunded, received); !ok {
+		if alreadyRefunded {
+			return "", errors.New("partial payment for this order has already been refunded")
+		}
+		return "", errors.New("no payment recorded for this order")
+	}
+	wallet, ok := l.wallets[coinType]
+	if !ok {
+		return "", errors.New("no wallet registered for coin " + string(coinType))
+	}
+	txid, err := wallet.Spend(received, contract.BuyerOrder.RefundAddress)
+	if err != nil {
+		return "", err
+	}
+	// Only marked refunded once the spend has actually gone out: marking it
+	// first and then failing the spend would strand the amount with no way
+	// to retry, since a later call would see refunded=true and refuse.
+	l.db.Sales().MarkPartialPaymentRefunded(orderId)
+	l.db.Sales().PutRefundTxid(orderId, txid)
+	return txid, nil
+}
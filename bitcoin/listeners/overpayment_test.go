@@ -0,0 +1,44 @@
+package bitcoin
+
+import "testing"
+
+func TestRefundable(t *testing.T) {
+	tests := []struct {
+		name                string
+		refunded            bool
+		amount              int64
+		wantOk              bool
+		wantAlreadyRefunded bool
+	}{
+		{
+			name:                "already refunded is rejected even with a positive amount",
+			refunded:            true,
+			amount:              1000,
+			wantOk:              false,
+			wantAlreadyRefunded: true,
+		},
+		{
+			name:                "nothing recorded is rejected",
+			refunded:            false,
+			amount:              0,
+			wantOk:              false,
+			wantAlreadyRefunded: false,
+		},
+		{
+			name:                "unrefunded positive amount can proceed",
+			refunded:            false,
+			amount:              1000,
+			wantOk:              true,
+			wantAlreadyRefunded: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotOk, gotAlreadyRefunded := refundable(tt.refunded, tt.amount)
+			if gotOk != tt.wantOk || gotAlreadyRefunded != tt.wantAlreadyRefunded {
+				t.Errorf("refundable(%v, %d) = (%v, %v), want (%v, %v)",
+					tt.refunded, tt.amount, gotOk, gotAlreadyRefunded, tt.wantOk, tt.wantAlreadyRefunded)
+			}
+		})
+	}
+}
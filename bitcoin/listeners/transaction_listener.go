@@ -7,8 +7,6 @@ import (
 	"github.com/OpenBazaar/openbazaar-go/pb"
 	"github.com/OpenBazaar/openbazaar-go/repo"
 	"github.com/OpenBazaar/spvwallet"
-	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/btcsuite/btcd/txscript"
 	"github.com/golang/protobuf/proto"
 	"github.com/op/go-logging"
 	mh "gx/ipfs/QmYf7ng2hG5XBtJA3tN34DQ2GUN5HNksEw1rLDkmr6vGku/go-multihash"
@@ -18,37 +16,75 @@ import (
 
 var log = logging.MustGetLogger("transaction-listener")
 
-type TransactionListener struct {
+// PurchaseFundedNotification wraps the stock notifications.PaymentNotification
+// with the coin the payment arrived in. notifications.PaymentNotification
+// itself lives upstream in api/notifications and can't be given a CoinType
+// field from here, so the coin is carried alongside it instead.
+type PurchaseFundedNotification struct {
+	notifications.PaymentNotification
+	CoinType string `json:"coinType"`
+}
+
+// MultiwalletListener watches transactions across a registry of coin
+// wallets and dispatches sale/purchase bookkeeping to the right coin
+// regardless of whether it's UTXO-based (BTC, BCH, ZEC) or account-based
+// (ETH, FIL). It replaces the old BTC-only TransactionListener so that
+// non-UTXO coins can feed the same order state machine without forking it.
+type MultiwalletListener struct {
 	db        repo.Datastore
 	broadcast chan []byte
-	params    *chaincfg.Params
+	wallets   map[CoinType]Wallet
+	mempool   MempoolClient
+	chain     ChainClient
 	*sync.Mutex
 }
 
-func NewTransactionListener(db repo.Datastore, broadcast chan []byte, params *chaincfg.Params) *TransactionListener {
-	l := &TransactionListener{db, broadcast, params, new(sync.Mutex)}
+func NewMultiwalletListener(db repo.Datastore, broadcast chan []byte, wallets map[CoinType]Wallet, mempool MempoolClient, chain ChainClient) *MultiwalletListener {
+	l := &MultiwalletListener{db, broadcast, wallets, mempool, chain, new(sync.Mutex)}
 	return l
 }
 
-func (l *TransactionListener) OnTransactionReceived(cb spvwallet.TransactionCallback) {
+// OnTransactionReceived handles a transaction callback from the wallet for
+// coinType, looking up its payment addresses against both the sale and
+// purchase order books for that coin.
+func (l *MultiwalletListener) OnTransactionReceived(coinType CoinType, cb spvwallet.TransactionCallback) {
 	l.Lock()
 	defer l.Unlock()
+	wallet, ok := l.wallets[coinType]
+	if !ok {
+		log.Errorf("Received transaction for unregistered coin %s", coinType)
+		return
+	}
 	for _, output := range cb.Outputs {
-		_, addrs, _, _ := txscript.ExtractPkScriptAddrs(output.ScriptPubKey, l.params)
-		contract, state, funded, records, err := l.db.Sales().GetByPaymentAddress(addrs[0])
+		addr, err := wallet.AddressFromScript(output.ScriptPubKey)
+		if err != nil {
+			continue
+		}
+		contract, state, funded, records, err := l.db.Sales().GetByPaymentAddress(addr, coinType)
 		if err == nil {
-			l.processSalePayment(cb.Txid, output, contract, state, funded, records)
+			l.processSalePayment(coinType, cb, output, contract, state, funded, records)
 			continue
 		}
-		contract, _, funded, records, err = l.db.Purchases().GetByPaymentAddress(addrs[0])
+		contract, _, funded, records, err = l.db.Purchases().GetByPaymentAddress(addr, coinType)
 		if err == nil {
-			l.processPurchasePayment(cb.Txid, output, contract, funded, records)
+			l.processPurchasePayment(coinType, cb, output, contract, funded, records)
+			continue
+		}
+	}
+	for _, in := range cb.Inputs {
+		if l.chain == nil {
+			continue
+		}
+		prevout, err := l.chain.Vout(in.OutpointHash, in.OutpointIndex)
+		if err != nil {
 			continue
 		}
+		l.processOutgoingPayment(coinType, cb, in, prevout)
 	}
 }
 
-func (l *TransactionListener) processSalePayment(txid []byte, output spvwallet.TransactionOutput, contract *pb.RicardianContract, state pb.OrderState, funded bool, records []spvwallet.TransactionRecord) {
+func (l *MultiwalletListener) processSalePayment(coinType CoinType, cb spvwallet.TransactionCallback, output spvwallet.TransactionOutput, contract *pb.RicardianContract, state pb.OrderState, funded bool, records []spvwallet.TransactionRecord) {
+	txid := cb.Txid
 	funding := output.Value
 	for _, r := range records {
 		funding += r.Value
@@ -61,39 +97,62 @@ func (l *TransactionListener) processSalePayment(txid []byte, output spvwallet.T
 	if err != nil {
 		return
 	}
-	if !funded {
-		requestedAmount := int64(contract.BuyerOrder.Payment.Amount)
-		if funding >= requestedAmount {
-			log.Debugf("Recieved payment for order %s", orderId)
-			funded = true
-			if state == pb.OrderState_CONFIRMED {
-				l.db.Sales().Put(orderId, *contract, pb.OrderState_FUNDED, false)
-			}
-			l.adjustInventory(contract)
+	record := spvwallet.TransactionRecord{
+		Txid:   hex.EncodeToString(txid),
+		Index:  output.Index,
+		Value:  output.Value,
+		Inputs: outpointsOf(cb.Inputs),
+	}
+	if replacementTxid, replacementFee, conflict := l.detectConflict(cb); conflict {
+		log.Warningf("Conflicting spend of a funding input for order %s: %s replaces %s", orderId, replacementTxid, record.Txid)
+		record.ConflictsWith = replacementTxid
+		records = append(records, record)
+		l.db.Sales().UpdateFunding(orderId, funded, records)
+
+		n := notifications.Serialize(
+			DoubleSpendNotification{
+				orderId,
+				record.Txid,
+				replacementTxid,
+				replacementFee,
+			})
+		l.broadcast <- n
+		return
+	}
+	requestedAmount := int64(contract.BuyerOrder.Payment.Amount)
+	if !funded && funding >= requestedAmount {
+		log.Debugf("Recieved %s payment for order %s, awaiting confirmation", coinType, orderId)
+		funded = true
+		// The order only moves to FUNDED, fires the notification, and
+		// adjusts inventory once ConfirmationTracker has seen it reach
+		// the required confirmation depth. This keeps 0-conf and
+		// shallow-conf transactions from being treated as settled.
+	}
+	// Checked regardless of whether this payment is the one that first
+	// crossed requestedAmount: a second or duplicate payment arriving after
+	// the order is already funded still overpays it, and skipping this once
+	// funded was true reproduced the "first tx over threshold wins" bug for
+	// anything funding the order after that point.
+	if funding >= requestedAmount {
+		if delta := funding - requestedAmount; delta > DustThreshold {
+			l.db.Sales().PutOverpayment(orderId, delta)
 
 			n := notifications.Serialize(
-				notifications.OrderNotification{
-					contract.VendorListings[0].Item.Title,
-					contract.BuyerOrder.BuyerID.Guid,
-					contract.BuyerOrder.BuyerID.BlockchainID,
-					contract.VendorListings[0].Item.Images[0].Hash,
-					int(contract.BuyerOrder.Timestamp.Seconds),
+				OverpaymentNotification{
 					orderId,
+					requestedAmount,
+					funding,
+					delta,
 				})
-
 			l.broadcast <- n
 		}
 	}
-	record := spvwallet.TransactionRecord{
-		Txid:  hex.EncodeToString(txid),
-		Index: output.Index,
-		Value: output.Value,
-	}
 	records = append(records, record)
 	l.db.Sales().UpdateFunding(orderId, funded, records)
 }
 
-func (l *TransactionListener) processPurchasePayment(txid []byte, output spvwallet.TransactionOutput, contract *pb.RicardianContract, funded bool, records []spvwallet.TransactionRecord) {
+func (l *MultiwalletListener) processPurchasePayment(coinType CoinType, cb spvwallet.TransactionCallback, output spvwallet.TransactionOutput, contract *pb.RicardianContract, funded bool, records []spvwallet.TransactionRecord) {
+	txid := cb.Txid
 	funding := output.Value
 	for _, r := range records {
 		funding += r.Value
@@ -106,31 +165,41 @@ func (l *TransactionListener) processPurchasePayment(txid []byte, output spvwall
 	if err != nil {
 		return
 	}
-	if !funded {
-		requestedAmount := int64(contract.BuyerOrder.Payment.Amount)
-		if funding >= requestedAmount {
-			log.Debugf("Payment for purchase %s detected", orderId)
-			funded = true
-			l.db.Purchases().Put(orderId, *contract, pb.OrderState_FUNDED, true)
-
-			n := notifications.Serialize(
-				notifications.PaymentNotification{
-					orderId,
-				})
+	record := spvwallet.TransactionRecord{
+		Txid:   hex.EncodeToString(txid),
+		Index:  output.Index,
+		Value:  output.Value,
+		Inputs: outpointsOf(cb.Inputs),
+	}
+	if replacementTxid, replacementFee, conflict := l.detectConflict(cb); conflict {
+		log.Warningf("Conflicting spend of a funding input for purchase %s: %s replaces %s", orderId, replacementTxid, record.Txid)
+		record.ConflictsWith = replacementTxid
+		records = append(records, record)
+		l.db.Purchases().UpdateFunding(orderId, funded, records)
 
-			l.broadcast <- n
-		}
+		n := notifications.Serialize(
+			DoubleSpendNotification{
+				orderId,
+				record.Txid,
+				replacementTxid,
+				replacementFee,
+			})
+		l.broadcast <- n
+		return
 	}
-	record := spvwallet.TransactionRecord{
-		Txid:  hex.EncodeToString(txid),
-		Index: output.Index,
-		Value: output.Value,
+	requestedAmount := int64(contract.BuyerOrder.Payment.Amount)
+	if !funded && funding >= requestedAmount {
+		log.Debugf("%s payment for purchase %s detected, awaiting confirmation", coinType, orderId)
+		funded = true
+		// As with sales, the purchase only moves to FUNDED and fires the
+		// notification once ConfirmationTracker has seen it reach the
+		// required confirmation depth.
 	}
 	records = append(records, record)
 	l.db.Purchases().UpdateFunding(orderId, funded, records)
 }
 
-func (l *TransactionListener) adjustInventory(contract *pb.RicardianContract) {
+func (l *MultiwalletListener) adjustInventory(contract *pb.RicardianContract) {
 	inventory, err := l.db.Inventory().GetAll()
 	if err != nil {
 		return
@@ -182,4 +251,4 @@ func calcOrderId(order *pb.Order) (string, error) {
 		return "", err
 	}
 	return multihash.B58String(), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,22 @@
+package bitcoin
+
+import (
+	"github.com/OpenBazaar/spvwallet"
+	"testing"
+)
+
+func TestOnTransactionReceivedUnregisteredCoin(t *testing.T) {
+	// OnTransactionReceived must bail out before touching l.db once the
+	// callback's coin isn't in the wallet registry - dispatch has nothing
+	// to look an address up against, and there's no well-formed db query
+	// to make for a coin the listener doesn't know about.
+	l := NewMultiwalletListener(nil, make(chan []byte, 1), map[CoinType]Wallet{}, nil, nil)
+
+	l.OnTransactionReceived(CoinTypeBTC, spvwallet.TransactionCallback{})
+
+	select {
+	case n := <-l.broadcast:
+		t.Errorf("expected no broadcast for an unregistered coin, got %s", n)
+	default:
+	}
+}
@@ -0,0 +1,37 @@
+package bitcoin
+
+// CoinType identifies which cryptocurrency a wallet, order, or transaction
+// record belongs to. Payment addresses are not guaranteed to be unique
+// across coins (e.g. base58 BTC and BCH addresses can collide), so CoinType
+// is threaded alongside addresses wherever order lookups happen.
+type CoinType string
+
+const (
+	CoinTypeBTC CoinType = "BTC"
+	CoinTypeBCH CoinType = "BCH"
+	CoinTypeZEC CoinType = "ZEC"
+	CoinTypeETH CoinType = "ETH"
+	CoinTypeFIL CoinType = "FIL"
+)
+
+// Wallet is the subset of behavior MultiwalletListener needs from a coin's
+// wallet implementation. Both UTXO wallets (BTC, BCH, ZEC) and account-based
+// wallets (ETH, FIL) can satisfy it, which lets the listener dispatch sale
+// and purchase callbacks identically regardless of the underlying chain.
+type Wallet interface {
+	// WalletCoinType returns the coin this wallet instance services.
+	WalletCoinType() CoinType
+
+	// AddressFromScript decodes a raw output script into its payment
+	// address, using whatever scheme is appropriate for this coin
+	// (txscript for UTXO coins, RLP/ABI decoding for account-based ones).
+	AddressFromScript(script []byte) (string, error)
+
+	// ConfirmationsFor returns the current confirmation count for txid,
+	// as reported by this coin's chain client.
+	ConfirmationsFor(txid string) (uint32, error)
+
+	// Spend broadcasts a transaction paying amount to address and returns
+	// its txid. Used to send refunds for over- and under-paid orders.
+	Spend(amount int64, address string) (txid string, err error)
+}